@@ -0,0 +1,375 @@
+package nsq
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"math/rand"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrNoHealthyWriters is returned by ProducerPool when none of its backing
+// Writers are currently healthy enough to accept a publish.
+var ErrNoHealthyWriters = errors.New("no healthy writers")
+
+// Strategy selects which of a ProducerPool's healthy Writers should receive
+// the next publish.
+type Strategy interface {
+	// Choose returns the index into writers to use, given the message body
+	// being published.
+	Choose(writers []*Writer, body []byte) int
+}
+
+// RoundRobin is a Strategy that cycles through writers in order.
+type RoundRobin struct {
+	n uint64
+}
+
+// Choose implements Strategy.
+func (s *RoundRobin) Choose(writers []*Writer, body []byte) int {
+	n := atomic.AddUint64(&s.n, 1)
+	return int(n-1) % len(writers)
+}
+
+// Random is a Strategy that picks a writer uniformly at random.
+type Random struct{}
+
+// Choose implements Strategy.
+func (s *Random) Choose(writers []*Writer, body []byte) int {
+	return rand.Intn(len(writers))
+}
+
+// HashByKey is a Strategy that deterministically routes messages that share
+// a key (as extracted by KeyFn) to the same writer.
+type HashByKey struct {
+	KeyFn func(body []byte) []byte
+}
+
+// Choose implements Strategy.
+func (s *HashByKey) Choose(writers []*Writer, body []byte) int {
+	h := fnv.New32a()
+	h.Write(s.KeyFn(body))
+	return int(h.Sum32()) % len(writers)
+}
+
+// pooledWriter tracks the health of a single backing Writer so ProducerPool
+// can skip it while it's backing off, and offers it again (a "half-open"
+// retry) once the backoff expires. From then on every publish that chooses
+// it tries it, until one of them fails and a new backoff starts.
+type pooledWriter struct {
+	addr   string
+	writer *Writer
+
+	mtx     sync.Mutex
+	backoff time.Duration
+	retryAt time.Time
+}
+
+// isHealthy reports whether pw should be offered to Strategy: either it has
+// never failed, or its backoff has elapsed and it's due for a retry.
+func (p *pooledWriter) isHealthy() bool {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	return time.Now().After(p.retryAt)
+}
+
+func (p *pooledWriter) markUnhealthy() {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	if p.backoff == 0 {
+		p.backoff = 100 * time.Millisecond
+	} else if p.backoff < 30*time.Second {
+		p.backoff *= 2
+	}
+	p.retryAt = time.Now().Add(p.backoff)
+}
+
+func (p *pooledWriter) markHealthy() {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	p.backoff = 0
+	p.retryAt = time.Time{}
+}
+
+// ProducerPool is a high-level type that publishes to a set of `nsqd`
+// instances, fanning out across them according to a Strategy and failing
+// over to another instance when a publish attempt fails.
+//
+// Instances can be configured statically via ConnectToNSQDs, or discovered
+// (and kept up to date) via ConnectToNSQLookupd.
+type ProducerPool struct {
+	// MaxAttempts is the maximum number of writers that will be tried for a
+	// single publish before giving up.
+	MaxAttempts int
+	// LookupdPollInterval is how often ConnectToNSQLookupd polls for the
+	// current set of producers.
+	LookupdPollInterval time.Duration
+
+	authenticationPassword string
+	strategy               Strategy
+
+	mtx     sync.RWMutex
+	writers []*pooledWriter
+
+	lookupdAddr string
+	stopFlag    int32
+	exitChan    chan int
+	wg          sync.WaitGroup
+}
+
+// NewProducerPool returns an instance of ProducerPool that routes publishes
+// according to strategy.
+func NewProducerPool(authenticationPassword string, strategy Strategy) *ProducerPool {
+	return &ProducerPool{
+		MaxAttempts:         3,
+		LookupdPollInterval: 60 * time.Second,
+
+		authenticationPassword: authenticationPassword,
+		strategy:               strategy,
+
+		exitChan: make(chan int),
+	}
+}
+
+// ConnectToNSQDs adds a Writer for each of the given `nsqd` addresses.
+func (p *ProducerPool) ConnectToNSQDs(addrs []string) error {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	for _, addr := range addrs {
+		if p.findLocked(addr) != nil {
+			continue
+		}
+		p.addLocked(addr)
+	}
+
+	return nil
+}
+
+func (p *ProducerPool) findLocked(addr string) *pooledWriter {
+	for _, pw := range p.writers {
+		if pw.addr == addr {
+			return pw
+		}
+	}
+	return nil
+}
+
+func (p *ProducerPool) addLocked(addr string) *pooledWriter {
+	log.Printf("[producer_pool] adding %s", addr)
+	pw := &pooledWriter{
+		addr:   addr,
+		writer: NewWriter(addr, p.authenticationPassword),
+	}
+	pw.markHealthy()
+	p.writers = append(p.writers, pw)
+	return pw
+}
+
+func (p *ProducerPool) removeLocked(addr string) {
+	for i, pw := range p.writers {
+		if pw.addr == addr {
+			log.Printf("[producer_pool] removing %s", addr)
+			pw.writer.Stop()
+			p.writers = append(p.writers[:i], p.writers[i+1:]...)
+			return
+		}
+	}
+}
+
+// ConnectToNSQLookupd polls the /nodes endpoint of the given `nsqlookupd`
+// address on LookupdPollInterval, adding and removing backing Writers as
+// the set of producers changes.
+func (p *ProducerPool) ConnectToNSQLookupd(addr string) error {
+	p.lookupdAddr = addr
+
+	err := p.queryLookupd()
+	if err != nil {
+		return err
+	}
+
+	p.wg.Add(1)
+	go p.lookupdLoop()
+
+	return nil
+}
+
+func (p *ProducerPool) lookupdLoop() {
+	defer p.wg.Done()
+
+	ticker := time.NewTicker(p.LookupdPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			err := p.queryLookupd()
+			if err != nil {
+				log.Printf("ERROR: [producer_pool] failed to query nsqlookupd %s - %s", p.lookupdAddr, err)
+			}
+		case <-p.exitChan:
+			return
+		}
+	}
+}
+
+type lookupdNodesResponse struct {
+	Data struct {
+		Producers []struct {
+			BroadcastAddress string `json:"broadcast_address"`
+			TCPPort          int    `json:"tcp_port"`
+		} `json:"producers"`
+	} `json:"data"`
+}
+
+func (p *ProducerPool) queryLookupd() error {
+	url := fmt.Sprintf("http://%s/nodes", p.lookupdAddr)
+	resp, err := http.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var r lookupdNodesResponse
+	err = json.NewDecoder(resp.Body).Decode(&r)
+	if err != nil {
+		return err
+	}
+
+	addrs := make(map[string]bool)
+	for _, producer := range r.Data.Producers {
+		addr := fmt.Sprintf("%s:%d", producer.BroadcastAddress, producer.TCPPort)
+		addrs[addr] = true
+	}
+
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	for addr := range addrs {
+		if p.findLocked(addr) == nil {
+			p.addLocked(addr)
+		}
+	}
+
+	stale := make([]string, 0)
+	for _, pw := range p.writers {
+		if !addrs[pw.addr] {
+			stale = append(stale, pw.addr)
+		}
+	}
+	for _, addr := range stale {
+		p.removeLocked(addr)
+	}
+
+	return nil
+}
+
+// Publish synchronously publishes a message body to the specified topic,
+// failing over to another Writer (up to MaxAttempts times) if the attempt
+// fails.
+func (p *ProducerPool) Publish(topic string, body []byte) (int32, []byte, error) {
+	return p.publish(func(w *Writer) (int32, []byte, error) {
+		return w.Publish(topic, body)
+	}, body)
+}
+
+// MultiPublish synchronously publishes a slice of message bodies to the
+// specified topic, failing over to another Writer (up to MaxAttempts times)
+// if the attempt fails.
+func (p *ProducerPool) MultiPublish(topic string, body [][]byte) (int32, []byte, error) {
+	var key []byte
+	if len(body) > 0 {
+		key = body[0]
+	}
+	return p.publish(func(w *Writer) (int32, []byte, error) {
+		return w.MultiPublish(topic, body)
+	}, key)
+}
+
+// PublishAsync publishes a message body to the specified topic but does not
+// wait for the response from `nsqd`, failing over to another Writer (up to
+// MaxAttempts times) if the attempt to enqueue it fails.
+func (p *ProducerPool) PublishAsync(topic string, body []byte, doneChan chan *WriterTransaction, args ...interface{}) error {
+	_, _, err := p.publish(func(w *Writer) (int32, []byte, error) {
+		return -1, nil, w.PublishAsync(topic, body, doneChan, args...)
+	}, body)
+	return err
+}
+
+func (p *ProducerPool) publish(fn func(w *Writer) (int32, []byte, error), key []byte) (int32, []byte, error) {
+	var lastErr error
+
+	attempts := p.MaxAttempts
+	if attempts <= 0 {
+		attempts = 1
+	}
+
+	for i := 0; i < attempts; i++ {
+		pw := p.choose(key)
+		if pw == nil {
+			if lastErr != nil {
+				return -1, nil, lastErr
+			}
+			return -1, nil, ErrNoHealthyWriters
+		}
+
+		frameType, data, err := fn(pw.writer)
+		if err != nil || frameType == FrameTypeError {
+			if err == nil {
+				err = errors.New(string(data))
+			}
+			lastErr = err
+			pw.markUnhealthy()
+			continue
+		}
+
+		pw.markHealthy()
+		return frameType, data, nil
+	}
+
+	return -1, nil, lastErr
+}
+
+func (p *ProducerPool) choose(key []byte) *pooledWriter {
+	p.mtx.RLock()
+	defer p.mtx.RUnlock()
+
+	healthy := make([]*Writer, 0, len(p.writers))
+	byWriter := make(map[*Writer]*pooledWriter, len(p.writers))
+	for _, pw := range p.writers {
+		if pw.isHealthy() {
+			healthy = append(healthy, pw.writer)
+			byWriter[pw.writer] = pw
+		}
+	}
+
+	if len(healthy) == 0 {
+		return nil
+	}
+
+	idx := p.strategy.Choose(healthy, key)
+	return byWriter[healthy[idx]]
+}
+
+// Stop disconnects all backing Writers and stops polling nsqlookupd.
+func (p *ProducerPool) Stop() {
+	if !atomic.CompareAndSwapInt32(&p.stopFlag, 0, 1) {
+		return
+	}
+
+	if p.lookupdAddr != "" {
+		close(p.exitChan)
+	}
+	p.wg.Wait()
+
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	for _, pw := range p.writers {
+		pw.writer.Stop()
+	}
+}
@@ -0,0 +1,103 @@
+package nsq
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestProducerPoolRoundRobin(t *testing.T) {
+	nsqd1 := newMockNSQD(t, identifyResponse{})
+	defer nsqd1.Close()
+	nsqd2 := newMockNSQD(t, identifyResponse{})
+	defer nsqd2.Close()
+
+	p := NewProducerPool("", &RoundRobin{})
+	defer p.Stop()
+
+	if err := p.ConnectToNSQDs([]string{nsqd1.Addr(), nsqd2.Addr()}); err != nil {
+		t.Fatalf("ConnectToNSQDs failed: %s", err)
+	}
+
+	seen := make(map[string]int)
+	for i := 0; i < 4; i++ {
+		pw := p.choose([]byte("key"))
+		if pw == nil {
+			t.Fatal("choose returned nil")
+		}
+		seen[pw.addr]++
+	}
+
+	if seen[nsqd1.Addr()] != 2 || seen[nsqd2.Addr()] != 2 {
+		t.Fatalf("expected round-robin to split evenly, got %v", seen)
+	}
+}
+
+func TestProducerPoolFailover(t *testing.T) {
+	down := newMockNSQD(t, identifyResponse{})
+	up := newMockNSQD(t, identifyResponse{})
+	defer up.Close()
+
+	p := NewProducerPool("", &RoundRobin{})
+	p.MaxAttempts = 2
+	defer p.Stop()
+
+	if err := p.ConnectToNSQDs([]string{down.Addr(), up.Addr()}); err != nil {
+		t.Fatalf("ConnectToNSQDs failed: %s", err)
+	}
+
+	// Kill the first writer's backing nsqd before any publish is attempted,
+	// so the pool must fail over to the second one within MaxAttempts.
+	down.Close()
+
+	frameType, _, err := p.Publish("test-topic", []byte("hello"))
+	if err != nil {
+		t.Fatalf("Publish failed: %s", err)
+	}
+	if frameType != FrameTypeResponse {
+		t.Fatalf("expected FrameTypeResponse, got %d", frameType)
+	}
+}
+
+func TestProducerPoolLookupd(t *testing.T) {
+	nsqd := newMockNSQD(t, identifyResponse{})
+	defer nsqd.Close()
+
+	_, portStr, err := net.SplitHostPort(nsqd.Addr())
+	if err != nil {
+		t.Fatalf("failed to split nsqd addr: %s", err)
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		t.Fatalf("failed to parse nsqd port: %s", err)
+	}
+
+	lookupd := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var resp lookupdNodesResponse
+		resp.Data.Producers = []struct {
+			BroadcastAddress string `json:"broadcast_address"`
+			TCPPort          int    `json:"tcp_port"`
+		}{
+			{BroadcastAddress: "127.0.0.1", TCPPort: port},
+		}
+		json.NewEncoder(w).Encode(resp)
+	}))
+	defer lookupd.Close()
+
+	p := NewProducerPool("", &RoundRobin{})
+	p.LookupdPollInterval = 10 * time.Millisecond
+	defer p.Stop()
+
+	if err := p.ConnectToNSQLookupd(lookupd.Listener.Addr().String()); err != nil {
+		t.Fatalf("ConnectToNSQLookupd failed: %s", err)
+	}
+
+	pw := p.choose([]byte("key"))
+	if pw == nil {
+		t.Fatal("expected a writer discovered via nsqlookupd, got none")
+	}
+}
@@ -3,14 +3,22 @@ package nsq
 import (
 	"bufio"
 	"bytes"
+	"compress/flate"
+	"context"
+	"crypto/tls"
+	"encoding/json"
 	"errors"
+	"io"
 	"log"
+	"math/rand"
 	"net"
 	"os"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
+
+	"github.com/mreiferson/go-snappystream"
 )
 
 // Writer is a high-level type to publish to NSQ.
@@ -27,8 +35,58 @@ type Writer struct {
 	ShortIdentifier   string
 	LongIdentifier    string
 
+	// Snappy enables snappy stream compression on the connection, negotiated
+	// as part of IDENTIFY. Snappy and Deflate are mutually exclusive.
+	Snappy bool
+	// Deflate enables deflate stream compression on the connection, negotiated
+	// as part of IDENTIFY. Snappy and Deflate are mutually exclusive.
+	Deflate bool
+	// DeflateLevel configures the compression level used when Deflate is enabled
+	// (see compress/flate for valid values). Ignored unless Deflate is true.
+	DeflateLevel int
+
+	// TLS enables a TLS handshake on the connection, negotiated as part of
+	// IDENTIFY, before any compression is layered on top.
+	TLS bool
+	// TLSConfig is the configuration used to upgrade the connection when TLS is enabled.
+	TLSConfig *tls.Config
+
+	// ReconnectInitialDelay is the delay before the first reconnect attempt
+	// after an unexpected disconnect.
+	ReconnectInitialDelay time.Duration
+	// ReconnectMaxDelay caps the exponential backoff applied between
+	// subsequent reconnect attempts.
+	ReconnectMaxDelay time.Duration
+	// ReconnectJitter is the fraction (0.0-1.0) of each backoff delay that is
+	// randomized, to avoid a thundering herd of reconnects.
+	ReconnectJitter float64
+
+	// MaxInFlight caps the number of commands that may be written to the wire
+	// awaiting a response at any one time. <= 0 means unlimited.
+	MaxInFlight int
+	// MaxQueueDepth bounds the number of messages PublishAsync/MultiPublishAsync
+	// will accept before applying back-pressure. <= 0 means unlimited.
+	MaxQueueDepth int
+	// LingerMs is the window, in milliseconds, during which PublishAsync calls
+	// for the same topic are coalesced into a single MPUB. <= 0 disables batching.
+	LingerMs int
+
 	concurrentWriters int32
 
+	connectionStateHandler func(state int32, err error)
+
+	messagesPublished int64
+	bytesWritten      int64
+	reconnects        int64
+	queueDepth        int64
+	needsReconnect    int32
+
+	queueTokensOnce sync.Once
+	queueTokens     chan struct{}
+
+	batchMtx sync.Mutex
+	batches  map[string]*writerBatch
+
 	transactionChan chan *WriterTransaction
 	dataChan        chan []byte
 	transactions    []*WriterTransaction
@@ -38,7 +96,12 @@ type Writer struct {
 	closeChan       chan int
 	wg              sync.WaitGroup
 
-    authenticationPassword string
+	authenticationPassword string
+
+	// r and w wrap w.Conn and are what readLoop/messageRouter actually use;
+	// they're upgraded to a compressing stream once IDENTIFY negotiation completes
+	r io.Reader
+	w io.Writer
 }
 
 // WriterTransaction is returned by the async publish methods
@@ -51,9 +114,26 @@ type WriterTransaction struct {
 	Data      []byte        // the response data of the publish command
 	Error     error         // the error (or nil) of the publish command
 	Args      []interface{} // the slice of variadic arguments passed to PublishAsync or MultiPublishAsync
+
+	// msgCount is the number of messages this transaction represents, for
+	// releasing the corresponding number of queue tokens once it completes.
+	msgCount int
+	// batched holds the per-message transactions a batched MPUB was built
+	// from, so the single response it receives can fan back out to each
+	// caller. Only set on the transaction actually pushed to transactionChan.
+	batched []*WriterTransaction
 }
 
 func (t *WriterTransaction) finish() {
+	if len(t.batched) > 0 {
+		for _, sub := range t.batched {
+			sub.FrameType = t.FrameType
+			sub.Data = t.Data
+			sub.Error = t.Error
+			sub.finish()
+		}
+		return
+	}
 	if t.doneChan != nil {
 		t.doneChan <- t
 	}
@@ -65,6 +145,26 @@ var ErrNotConnected = errors.New("not connected")
 // returned when a publish command is made against a Writer that has been stopped
 var ErrStopped = errors.New("stopped")
 
+// returned by PublishAsync (in non-blocking mode) when MaxQueueDepth has been reached
+var ErrPublishQueueFull = errors.New("publish queue full")
+
+// writerBatch accumulates PublishAsync calls for a single topic during the
+// LingerMs window so they can be written as one MPUB.
+type writerBatch struct {
+	topic  string
+	bodies [][]byte
+	subs   []*WriterTransaction
+	timer  *time.Timer
+}
+
+// identifyResponse represents the negotiated feature set returned by nsqd
+// in response to IDENTIFY, only the fields Writer cares about are included.
+type identifyResponse struct {
+	TLSv1   bool `json:"tls_v1"`
+	Snappy  bool `json:"snappy"`
+	Deflate bool `json:"deflate"`
+}
+
 // NewWriter returns an instance of Writer for the specified address
 func NewWriter(addr string, authenticationPassword string) *Writer {
 	hostname, err := os.Hostname()
@@ -84,7 +184,11 @@ func NewWriter(addr string, authenticationPassword string) *Writer {
 		ShortIdentifier:   strings.Split(hostname, ".")[0],
 		LongIdentifier:    hostname,
 
-        authenticationPassword:     authenticationPassword,
+		ReconnectInitialDelay: 100 * time.Millisecond,
+		ReconnectMaxDelay:     60 * time.Second,
+		ReconnectJitter:       0.3,
+
+		authenticationPassword: authenticationPassword,
 	}
 }
 
@@ -93,12 +197,45 @@ func (w *Writer) String() string {
 	return w.Addr
 }
 
+// SetConnectionStateHandler registers a callback that is invoked whenever the
+// Writer's connection state transitions between StateInit, StateConnected,
+// and StateDisconnected. err is non-nil when the transition was caused by a
+// connection failure. It should be set before the first Publish.
+func (w *Writer) SetConnectionStateHandler(handler func(state int32, err error)) {
+	w.connectionStateHandler = handler
+}
+
+// WriterStats holds a snapshot of a Writer's runtime counters.
+type WriterStats struct {
+	MessagesPublished int64
+	BytesWritten      int64
+	Reconnects        int64
+	QueueDepth        int64
+}
+
+// Stats returns a snapshot of the Writer's runtime counters.
+func (w *Writer) Stats() WriterStats {
+	return WriterStats{
+		MessagesPublished: atomic.LoadInt64(&w.messagesPublished),
+		BytesWritten:      atomic.LoadInt64(&w.bytesWritten),
+		Reconnects:        atomic.LoadInt64(&w.reconnects),
+		QueueDepth:        atomic.LoadInt64(&w.queueDepth),
+	}
+}
+
+func (w *Writer) notifyConnectionState(state int32, err error) {
+	if w.connectionStateHandler != nil {
+		w.connectionStateHandler(state, err)
+	}
+}
+
 // Stop disconnects and permanently stops the Writer
 func (w *Writer) Stop() {
 	if !atomic.CompareAndSwapInt32(&w.stopFlag, 0, 1) {
 		return
 	}
-	w.close()
+	close(w.exitChan)
+	w.close(nil)
 	w.wg.Wait()
 }
 
@@ -109,8 +246,42 @@ func (w *Writer) Stop() {
 // the supplied `doneChan` (if specified)
 // will receive a `WriterTransaction` instance with the supplied variadic arguments
 // (and the response `FrameType`, `Data`, and `Error`)
+//
+// If MaxQueueDepth is configured and the queue is full, PublishAsync returns
+// ErrPublishQueueFull immediately. Use PublishAsyncWithContext to block
+// (subject to cancellation) instead.
 func (w *Writer) PublishAsync(topic string, body []byte, doneChan chan *WriterTransaction, args ...interface{}) error {
-	return w.sendCommandAsync(Publish(topic, body), doneChan, args)
+	return w.publishAsync(w.reserveQueueTokensNonBlocking, topic, body, doneChan, args)
+}
+
+// PublishAsyncWithContext behaves like PublishAsync, except that when
+// MaxQueueDepth is reached it blocks until a slot frees up, ctx is done, or
+// the Writer is stopped, rather than immediately returning ErrPublishQueueFull.
+func (w *Writer) PublishAsyncWithContext(ctx context.Context, topic string, body []byte, doneChan chan *WriterTransaction, args ...interface{}) error {
+	reserve := func(n int) error { return w.reserveQueueTokensCtx(n, ctx) }
+	return w.publishAsync(reserve, topic, body, doneChan, args)
+}
+
+func (w *Writer) publishAsync(reserve func(n int) error, topic string, body []byte, doneChan chan *WriterTransaction, args []interface{}) error {
+	err := reserve(1)
+	if err != nil {
+		return err
+	}
+
+	t := &WriterTransaction{
+		doneChan:  doneChan,
+		FrameType: -1,
+		Args:      args,
+		msgCount:  1,
+	}
+
+	if w.LingerMs <= 0 {
+		t.cmd = Publish(topic, body)
+		return w.enqueueTransaction(t)
+	}
+
+	w.joinBatch(topic, body, t)
+	return nil
 }
 
 // MultiPublishAsync publishes a slice of message bodies to the specified topic
@@ -125,13 +296,13 @@ func (w *Writer) MultiPublishAsync(topic string, body [][]byte, doneChan chan *W
 	if err != nil {
 		return err
 	}
-	return w.sendCommandAsync(cmd, doneChan, args)
+	return w.sendCommandAsync(cmd, doneChan, args, len(body))
 }
 
 // Publish synchronously publishes a message body to the specified topic, returning
 // the response frameType, data, and error
 func (w *Writer) Publish(topic string, body []byte) (int32, []byte, error) {
-	return w.sendCommand(Publish(topic, body))
+	return w.sendCommand(Publish(topic, body), 1)
 }
 
 // MultiPublish synchronously publishes a slice of message bodies to the specified topic, returning
@@ -141,12 +312,12 @@ func (w *Writer) MultiPublish(topic string, body [][]byte) (int32, []byte, error
 	if err != nil {
 		return -1, nil, err
 	}
-	return w.sendCommand(cmd)
+	return w.sendCommand(cmd, len(body))
 }
 
-func (w *Writer) sendCommand(cmd *Command) (int32, []byte, error) {
+func (w *Writer) sendCommand(cmd *Command, msgCount int) (int32, []byte, error) {
 	doneChan := make(chan *WriterTransaction)
-	err := w.sendCommandAsync(cmd, doneChan, nil)
+	err := w.sendCommandAsync(cmd, doneChan, nil, msgCount)
 	if err != nil {
 		close(doneChan)
 		return -1, nil, err
@@ -155,7 +326,28 @@ func (w *Writer) sendCommand(cmd *Command) (int32, []byte, error) {
 	return t.FrameType, t.Data, t.Error
 }
 
-func (w *Writer) sendCommandAsync(cmd *Command, doneChan chan *WriterTransaction, args []interface{}) error {
+func (w *Writer) sendCommandAsync(cmd *Command, doneChan chan *WriterTransaction, args []interface{}, msgCount int) error {
+	// synchronous callers and MultiPublishAsync always wait for a queue slot
+	// (rather than fail fast); only PublishAsync exposes ErrPublishQueueFull
+	err := w.reserveQueueTokensBlocking(msgCount)
+	if err != nil {
+		return err
+	}
+
+	t := &WriterTransaction{
+		cmd:       cmd,
+		doneChan:  doneChan,
+		FrameType: -1,
+		Args:      args,
+		msgCount:  msgCount,
+	}
+
+	return w.enqueueTransaction(t)
+}
+
+// enqueueTransaction lazily connects (if necessary) and hands t off to
+// messageRouter. On failure it releases any queue tokens t was holding.
+func (w *Writer) enqueueTransaction(t *WriterTransaction) error {
 	// keep track of how many outstanding writers we're dealing with
 	// in order to later ensure that we clean them all up...
 	atomic.AddInt32(&w.concurrentWriters, 1)
@@ -164,26 +356,171 @@ func (w *Writer) sendCommandAsync(cmd *Command, doneChan chan *WriterTransaction
 	if atomic.LoadInt32(&w.state) != StateConnected {
 		err := w.connect()
 		if err != nil {
+			w.releaseQueueTokens(t.msgCount)
 			return err
 		}
 	}
 
-	t := &WriterTransaction{
-		cmd:       cmd,
-		doneChan:  doneChan,
-		FrameType: -1,
-		Args:      args,
-	}
-
 	select {
 	case w.transactionChan <- t:
 	case <-w.exitChan:
+		w.releaseQueueTokens(t.msgCount)
 		return ErrStopped
 	}
 
 	return nil
 }
 
+func (w *Writer) initQueueTokens() {
+	if w.MaxQueueDepth > 0 {
+		w.queueTokens = make(chan struct{}, w.MaxQueueDepth)
+	}
+}
+
+// reserveQueueTokensBlocking accounts for n messages against MaxQueueDepth (a
+// no-op if MaxQueueDepth is unset), blocking until n slots are free or the
+// Writer is stopped. Used by every send path except PublishAsync/
+// PublishAsyncWithContext, which have their own back-pressure contract.
+func (w *Writer) reserveQueueTokensBlocking(n int) error {
+	w.queueTokensOnce.Do(w.initQueueTokens)
+	if w.queueTokens == nil {
+		return nil
+	}
+
+	for acquired := 0; acquired < n; acquired++ {
+		select {
+		case w.queueTokens <- struct{}{}:
+		case <-w.exitChan:
+			w.releaseQueueTokens(acquired)
+			return ErrStopped
+		}
+	}
+
+	return nil
+}
+
+// reserveQueueTokensNonBlocking accounts for n messages against
+// MaxQueueDepth, returning ErrPublishQueueFull immediately if that would
+// exceed it. Used by PublishAsync.
+func (w *Writer) reserveQueueTokensNonBlocking(n int) error {
+	w.queueTokensOnce.Do(w.initQueueTokens)
+	if w.queueTokens == nil {
+		return nil
+	}
+
+	for acquired := 0; acquired < n; acquired++ {
+		select {
+		case w.queueTokens <- struct{}{}:
+		default:
+			w.releaseQueueTokens(acquired)
+			return ErrPublishQueueFull
+		}
+	}
+
+	return nil
+}
+
+// reserveQueueTokensCtx accounts for n messages against MaxQueueDepth,
+// blocking until n slots are free, ctx is done, or the Writer is stopped.
+// Used by PublishAsyncWithContext.
+func (w *Writer) reserveQueueTokensCtx(n int, ctx context.Context) error {
+	w.queueTokensOnce.Do(w.initQueueTokens)
+	if w.queueTokens == nil {
+		return nil
+	}
+
+	for acquired := 0; acquired < n; acquired++ {
+		select {
+		case w.queueTokens <- struct{}{}:
+		case <-ctx.Done():
+			w.releaseQueueTokens(acquired)
+			return ctx.Err()
+		case <-w.exitChan:
+			w.releaseQueueTokens(acquired)
+			return ErrStopped
+		}
+	}
+
+	return nil
+}
+
+func (w *Writer) releaseQueueTokens(n int) {
+	if w.queueTokens == nil {
+		return
+	}
+	for i := 0; i < n; i++ {
+		<-w.queueTokens
+	}
+}
+
+// joinBatch adds body to the in-flight batch for topic, creating one (and
+// arming its LingerMs flush timer) if this is the first message to arrive
+// for that topic since the last flush.
+func (w *Writer) joinBatch(topic string, body []byte, t *WriterTransaction) {
+	w.batchMtx.Lock()
+	defer w.batchMtx.Unlock()
+
+	if w.batches == nil {
+		w.batches = make(map[string]*writerBatch)
+	}
+
+	b, ok := w.batches[topic]
+	if !ok {
+		b = &writerBatch{topic: topic}
+		w.batches[topic] = b
+		linger := time.Duration(w.LingerMs) * time.Millisecond
+		b.timer = time.AfterFunc(linger, func() { w.flushBatch(topic) })
+	}
+	b.bodies = append(b.bodies, body)
+	b.subs = append(b.subs, t)
+}
+
+// flushBatch builds and enqueues the MPUB (or PUB, for a batch of one) that
+// a topic's accumulated PublishAsync calls coalesced into, fanning the
+// eventual response back out to each caller's WriterTransaction.
+func (w *Writer) flushBatch(topic string) {
+	w.batchMtx.Lock()
+	b := w.batches[topic]
+	delete(w.batches, topic)
+	w.batchMtx.Unlock()
+
+	if b == nil {
+		return
+	}
+
+	var cmd *Command
+	var err error
+	if len(b.bodies) == 1 {
+		cmd = Publish(topic, b.bodies[0])
+	} else {
+		cmd, err = MultiPublish(topic, b.bodies)
+	}
+
+	if err != nil {
+		for _, sub := range b.subs {
+			sub.Error = err
+			w.releaseQueueTokens(1)
+			sub.finish()
+		}
+		return
+	}
+
+	parent := &WriterTransaction{
+		cmd:       cmd,
+		FrameType: -1,
+		msgCount:  len(b.subs),
+		batched:   b.subs,
+	}
+
+	err = w.enqueueTransaction(parent)
+	if err != nil {
+		for _, sub := range b.subs {
+			sub.Error = err
+			sub.finish()
+		}
+	}
+}
+
 func (w *Writer) connect() error {
 	if atomic.LoadInt32(&w.stopFlag) == 1 {
 		return ErrStopped
@@ -198,17 +535,20 @@ func (w *Writer) connect() error {
 	if err != nil {
 		log.Printf("ERROR: [%s] failed to dial %s - %s", w, w.Addr, err)
 		atomic.StoreInt32(&w.state, StateInit)
+		w.notifyConnectionState(StateInit, err)
 		return err
 	}
 
 	w.closeChan = make(chan int)
 	w.Conn = conn
+	w.r = conn
+	w.w = conn
 
 	w.SetWriteDeadline(time.Now().Add(w.WriteTimeout))
 	_, err = w.Write(MagicV2)
 	if err != nil {
 		log.Printf("ERROR: [%s] failed to write magic - %s", w, err)
-		w.close()
+		w.close(err)
 		return err
 	}
 
@@ -218,10 +558,22 @@ func (w *Writer) connect() error {
 	ci["heartbeat_interval"] = int64(w.HeartbeatInterval / time.Millisecond)
 	ci["feature_negotiation"] = true
 	ci["authentication_password"] = w.authenticationPassword
+	if w.TLS {
+		ci["tls_v1"] = true
+	}
+	if w.Snappy {
+		ci["snappy"] = true
+	}
+	if w.Deflate {
+		ci["deflate"] = true
+		if w.DeflateLevel != 0 {
+			ci["deflate_level"] = w.DeflateLevel
+		}
+	}
 	cmd, err := Identify(ci)
 	if err != nil {
 		log.Printf("ERROR: [%s] failed to create IDENTIFY command - %s", w, err)
-		w.close()
+		w.close(err)
 		return err
 	}
 
@@ -229,7 +581,7 @@ func (w *Writer) connect() error {
 	err = cmd.Write(w)
 	if err != nil {
 		log.Printf("ERROR: [%s] failed to write IDENTIFY - %s", w, err)
-		w.close()
+		w.close(err)
 		return err
 	}
 
@@ -237,23 +589,109 @@ func (w *Writer) connect() error {
 	resp, err := ReadResponse(w)
 	if err != nil {
 		log.Printf("ERROR: [%s] failed to read IDENTIFY response - %s", w, err)
-		w.close()
+		w.close(err)
 		return err
 	}
 
 	frameType, data, err := UnpackResponse(resp)
 	if err != nil {
 		log.Printf("ERROR: [%s] failed to unpack IDENTIFY response - %s", w, resp)
-		w.close()
+		w.close(err)
 		return err
 	}
 
 	if frameType == FrameTypeError {
+		identifyErr := errors.New(string(data))
 		log.Printf("ERROR: [%s] IDENTIFY returned error response - %s", w, data)
-		w.close()
-		return errors.New(string(data))
+		w.close(identifyErr)
+		return identifyErr
+	}
+
+	if w.TLS || w.Snappy || w.Deflate {
+		var resp identifyResponse
+		err := json.Unmarshal(data, &resp)
+		if err != nil {
+			log.Printf("ERROR: [%s] failed to parse IDENTIFY response - %s", w, err)
+			w.close(err)
+			return err
+		}
+
+		if resp.TLSv1 {
+			log.Printf("[%s] upgrading to TLS", w)
+			tlsConn := tls.Client(w.Conn, w.TLSConfig)
+			err := tlsConn.Handshake()
+			if err != nil {
+				log.Printf("ERROR: [%s] failed to negotiate TLS - %s", w, err)
+				w.close(err)
+				return err
+			}
+			w.Conn = tlsConn
+			w.r = tlsConn
+			w.w = tlsConn
+
+			resp, err := ReadResponse(w.r)
+			if err != nil {
+				log.Printf("ERROR: [%s] failed to read post-TLS _OK_ - %s", w, err)
+				w.close(err)
+				return err
+			}
+
+			frameType, data, err := UnpackResponse(resp)
+			if err != nil || frameType != FrameTypeResponse || !bytes.Equal(data, []byte("OK")) {
+				log.Printf("ERROR: [%s] unexpected post-TLS response - %s", w, resp)
+				if err == nil {
+					err = errors.New("failed to negotiate TLS")
+				}
+				w.close(err)
+				return errors.New("failed to negotiate TLS")
+			}
+		}
+
+		if resp.Snappy {
+			w.r = snappystream.NewReader(w.Conn, false)
+			w.w = snappystream.NewWriter(w.Conn)
+		} else if resp.Deflate {
+			w.r = flate.NewReader(w.Conn)
+			fw, err := flate.NewWriter(w.Conn, w.DeflateLevel)
+			if err != nil {
+				log.Printf("ERROR: [%s] failed to initialize flate writer - %s", w, err)
+				w.close(err)
+				return err
+			}
+			w.w = &flushingWriter{fw}
+		}
+
+		if resp.Snappy || resp.Deflate {
+			resp, err := ReadResponse(w.r)
+			if err != nil {
+				log.Printf("ERROR: [%s] failed to read post-compression _OK_ - %s", w, err)
+				w.close(err)
+				return err
+			}
+
+			frameType, data, err := UnpackResponse(resp)
+			if err != nil || frameType != FrameTypeResponse || !bytes.Equal(data, []byte("OK")) {
+				log.Printf("ERROR: [%s] unexpected post-compression response - %s", w, resp)
+				if err == nil {
+					err = errors.New("failed to enable compression")
+				}
+				w.close(err)
+				return errors.New("failed to enable compression")
+			}
+		}
+	}
+
+	w.w = &countingWriter{Writer: w.w, n: &w.bytesWritten}
+
+	// count this as a reconnect regardless of which goroutine (a lazily
+	// connecting Publish, or the supervised reconnectLoop) won the race to
+	// get here, so Stats().Reconnects is accurate either way.
+	if atomic.CompareAndSwapInt32(&w.needsReconnect, 1, 0) {
+		atomic.AddInt64(&w.reconnects, 1)
 	}
 
+	w.notifyConnectionState(StateConnected, nil)
+
 	w.wg.Add(2)
 	go w.readLoop()
 	go w.messageRouter()
@@ -261,47 +699,147 @@ func (w *Writer) connect() error {
 	return nil
 }
 
-func (w *Writer) close() {
+func (w *Writer) close(err error) {
 	if !atomic.CompareAndSwapInt32(&w.state, StateConnected, StateDisconnected) {
 		return
 	}
+	w.notifyConnectionState(StateDisconnected, err)
 	close(w.closeChan)
 	w.Conn.Close()
 	go func() {
 		// we need to handle this in a goroutine so we don't
 		// block the caller from making progress
 		w.wg.Wait()
+
+		// an unexpected disconnect (as opposed to Stop()) gets a supervised
+		// reconnect with backoff so callers don't have to re-trigger
+		// connect() via the next Publish. needsReconnect is set before the
+		// state returns to StateInit so that whichever connect() runs next
+		// counts the reconnect.
+		reconnect := err != nil && atomic.LoadInt32(&w.stopFlag) == 0
+		if reconnect {
+			atomic.StoreInt32(&w.needsReconnect, 1)
+		}
 		atomic.StoreInt32(&w.state, StateInit)
+		w.notifyConnectionState(StateInit, nil)
+
+		if reconnect {
+			go w.reconnectLoop()
+		}
 	}()
 }
 
+// reconnectLoop retries connect() with exponential backoff until it
+// succeeds, the Writer is stopped, or connect() returns ErrNotConnected
+// because another goroutine's connect() is already under way. In that last
+// case the loop exits and does not retry if that other attempt fails.
+func (w *Writer) reconnectLoop() {
+	delay := w.ReconnectInitialDelay
+	if delay <= 0 {
+		delay = 100 * time.Millisecond
+	}
+
+	for {
+		if atomic.LoadInt32(&w.stopFlag) == 1 {
+			return
+		}
+
+		select {
+		case <-time.After(jitter(delay, w.ReconnectJitter)):
+		case <-w.exitChan:
+			return
+		}
+
+		err := w.connect()
+		if err == nil || err == ErrStopped {
+			return
+		}
+		if err == ErrNotConnected {
+			// Another goroutine (a lazily-connecting Publish) is already
+			// connecting; this loop leaves the reconnect to it.
+			return
+		}
+
+		delay *= 2
+		if w.ReconnectMaxDelay > 0 && delay > w.ReconnectMaxDelay {
+			delay = w.ReconnectMaxDelay
+		}
+	}
+}
+
+// flushingWriter flushes a *flate.Writer after every Write. Unlike
+// snappystream (which frames each Write on its own), compress/flate buffers
+// internally, so without this PUB/MPUB/NOP commands would sit unsent until
+// enough data accumulated to fill a block.
+type flushingWriter struct {
+	w *flate.Writer
+}
+
+func (fw *flushingWriter) Write(p []byte) (int, error) {
+	n, err := fw.w.Write(p)
+	if err != nil {
+		return n, err
+	}
+	return n, fw.w.Flush()
+}
+
+// countingWriter tallies the number of bytes written through it so Writer
+// can expose BytesWritten via Stats().
+type countingWriter struct {
+	io.Writer
+	n *int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.Writer.Write(p)
+	atomic.AddInt64(cw.n, int64(n))
+	return n, err
+}
+
+func jitter(d time.Duration, frac float64) time.Duration {
+	if frac <= 0 {
+		return d
+	}
+	spread := float64(d) * frac
+	return d - time.Duration(spread/2) + time.Duration(rand.Float64()*spread)
+}
+
 func (w *Writer) messageRouter() {
 	for {
+		// MaxInFlight caps how many commands may be outstanding on the wire
+		// awaiting a response; disable the dequeue case once that's reached
+		// by selecting on a nil channel, which never becomes ready.
+		txChan := w.transactionChan
+		if w.MaxInFlight > 0 && len(w.transactions) >= w.MaxInFlight {
+			txChan = nil
+		}
+
 		select {
-		case t := <-w.transactionChan:
+		case t := <-txChan:
 			w.transactions = append(w.transactions, t)
+			atomic.AddInt64(&w.queueDepth, 1)
 			w.SetWriteDeadline(time.Now().Add(w.WriteTimeout))
-			err := t.cmd.Write(w.Conn)
+			err := t.cmd.Write(w.w)
 			if err != nil {
 				log.Printf("ERROR: [%s] failed writing %s", w, err)
-				w.close()
+				w.close(err)
 				goto exit
 			}
 		case buf := <-w.dataChan:
 			frameType, data, err := UnpackResponse(buf)
 			if err != nil {
 				log.Printf("ERROR: [%s] failed (%s) unpacking response %d %s", w, err, frameType, data)
-				w.close()
+				w.close(err)
 				goto exit
 			}
 
 			if frameType == FrameTypeResponse && bytes.Equal(data, []byte("_heartbeat_")) {
 				log.Printf("[%s] heartbeat received", w)
 				w.SetWriteDeadline(time.Now().Add(w.WriteTimeout))
-				err := Nop().Write(w.Conn)
+				err := Nop().Write(w.w)
 				if err != nil {
 					log.Printf("ERROR: [%s] failed sending heartbeat - %s", w, err)
-					w.close()
+					w.close(err)
 					goto exit
 				}
 				continue
@@ -309,10 +847,13 @@ func (w *Writer) messageRouter() {
 
 			t := w.transactions[0]
 			w.transactions = w.transactions[1:]
+			atomic.AddInt64(&w.queueDepth, -1)
 			t.FrameType = frameType
 			t.Data = data
 			t.Error = nil
+			atomic.AddInt64(&w.messagesPublished, int64(t.msgCount))
 			t.finish()
+			w.releaseQueueTokens(t.msgCount)
 		case <-w.closeChan:
 			goto exit
 		}
@@ -329,6 +870,8 @@ func (w *Writer) transactionCleanup() {
 	for _, t := range w.transactions {
 		t.Error = ErrNotConnected
 		t.finish()
+		w.releaseQueueTokens(t.msgCount)
+		atomic.AddInt64(&w.queueDepth, -1)
 	}
 	w.transactions = w.transactions[:0]
 
@@ -340,6 +883,7 @@ func (w *Writer) transactionCleanup() {
 		case t := <-w.transactionChan:
 			t.Error = ErrNotConnected
 			t.finish()
+			w.releaseQueueTokens(t.msgCount)
 		default:
 			// keep spinning until there are 0 concurrent writers
 			if atomic.LoadInt32(&w.concurrentWriters) == 0 {
@@ -353,7 +897,7 @@ func (w *Writer) transactionCleanup() {
 }
 
 func (w *Writer) readLoop() {
-	rbuf := bufio.NewReader(w.Conn)
+	rbuf := bufio.NewReader(w.r)
 	for {
 		w.SetReadDeadline(time.Now().Add(w.HeartbeatInterval * 2))
 		resp, err := ReadResponse(rbuf)
@@ -361,7 +905,7 @@ func (w *Writer) readLoop() {
 			if !strings.Contains(err.Error(), "use of closed network connection") {
 				log.Printf("ERROR: [%s] reading response %s", w, err)
 			}
-			w.close()
+			w.close(err)
 			goto exit
 		}
 		select {
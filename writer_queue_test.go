@@ -0,0 +1,144 @@
+package nsq
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"testing"
+	"time"
+)
+
+// withholdingOnConn answers the IDENTIFY/compression handshake normally (via
+// the caller-supplied identifyResponse) but blocks before responding to the
+// first command until release is closed, so a test can pin down exactly how
+// many messages are in flight before letting nsqd answer.
+func withholdingOnConn(release chan struct{}) func(t *testing.T, rd io.Reader, wr io.Writer) {
+	return func(t *testing.T, rd io.Reader, wr io.Writer) {
+		br := bufio.NewReader(rd)
+		for {
+			line, _, err := readCommand(br)
+			if err != nil {
+				return
+			}
+			if line == "NOP\n" {
+				continue
+			}
+			<-release
+			if err := writeFramedResponse(wr, FrameTypeResponse, []byte("OK")); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func TestWriterPublishAsyncQueueFull(t *testing.T) {
+	release := make(chan struct{})
+	nsqd := newMockNSQD(t, identifyResponse{})
+	nsqd.onConn = withholdingOnConn(release)
+	defer nsqd.Close()
+
+	w := NewWriter(nsqd.Addr(), "")
+	w.MaxQueueDepth = 1
+	defer w.Stop()
+
+	done1 := make(chan *WriterTransaction, 1)
+	if err := w.PublishAsync("test-topic", []byte("one"), done1); err != nil {
+		t.Fatalf("expected first PublishAsync to succeed, got %s", err)
+	}
+
+	// The mock is withholding its response to "one", so the single
+	// MaxQueueDepth slot is still held and this must fail deterministically
+	// rather than race the mock's near-instant round-trip.
+	done2 := make(chan *WriterTransaction, 1)
+	err := w.PublishAsync("test-topic", []byte("two"), done2)
+	if err != ErrPublishQueueFull {
+		t.Fatalf("expected ErrPublishQueueFull once MaxQueueDepth is exceeded, got %v", err)
+	}
+
+	close(release)
+
+	select {
+	case <-done1:
+	case <-time.After(2 * time.Second):
+		t.Fatal("first publish never completed")
+	}
+}
+
+func TestWriterPublishAsyncWithContextBlocksUntilSlotFrees(t *testing.T) {
+	release := make(chan struct{})
+	nsqd := newMockNSQD(t, identifyResponse{})
+	nsqd.onConn = withholdingOnConn(release)
+	defer nsqd.Close()
+
+	w := NewWriter(nsqd.Addr(), "")
+	w.MaxQueueDepth = 1
+	defer w.Stop()
+
+	done1 := make(chan *WriterTransaction, 1)
+	if err := w.PublishAsync("test-topic", []byte("one"), done1); err != nil {
+		t.Fatalf("expected first PublishAsync to succeed, got %s", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	unblocked := make(chan error, 1)
+	go func() {
+		unblocked <- w.PublishAsyncWithContext(ctx, "test-topic", []byte("two"), nil)
+	}()
+
+	select {
+	case <-unblocked:
+		t.Fatal("PublishAsyncWithContext returned before a queue slot freed up")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// Only now let the mock answer "one", freeing the single slot.
+	close(release)
+
+	select {
+	case <-done1:
+	case <-time.After(2 * time.Second):
+		t.Fatal("first publish never completed")
+	}
+
+	select {
+	case err := <-unblocked:
+		if err != nil {
+			t.Fatalf("expected PublishAsyncWithContext to succeed once a slot freed up, got %s", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("PublishAsyncWithContext did not unblock after a queue slot freed up")
+	}
+}
+
+func TestWriterPublishAsyncBatching(t *testing.T) {
+	nsqd := newMockNSQD(t, identifyResponse{})
+	defer nsqd.Close()
+
+	w := NewWriter(nsqd.Addr(), "")
+	w.LingerMs = 50
+	defer w.Stop()
+
+	const n = 5
+	doneChan := make(chan *WriterTransaction, n)
+	for i := 0; i < n; i++ {
+		if err := w.PublishAsync("test-topic", []byte("hello"), doneChan); err != nil {
+			t.Fatalf("PublishAsync failed: %s", err)
+		}
+	}
+
+	for i := 0; i < n; i++ {
+		select {
+		case trans := <-doneChan:
+			if trans.Error != nil {
+				t.Fatalf("transaction %d failed: %s", i, trans.Error)
+			}
+			if trans.FrameType != FrameTypeResponse {
+				t.Fatalf("transaction %d: expected FrameTypeResponse, got %d", i, trans.FrameType)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("only received %d/%d batched transactions", i, n)
+		}
+	}
+}
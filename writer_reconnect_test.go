@@ -0,0 +1,95 @@
+package nsq
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// killableMockNSQD wraps mockNSQD so a test can forcibly drop the current
+// connection (simulating a nsqd crash) and have the next Accept pick back
+// up normally, to exercise Writer's reconnect loop.
+type killableMockNSQD struct {
+	*mockNSQD
+	mtx  sync.Mutex
+	conn net.Conn
+}
+
+func newKillableMockNSQD(t *testing.T) *killableMockNSQD {
+	k := &killableMockNSQD{}
+	m := newMockNSQD(t, identifyResponse{})
+	m.onConn = func(t *testing.T, rd io.Reader, wr io.Writer) {
+		k.mtx.Lock()
+		k.conn, _ = wr.(net.Conn)
+		k.mtx.Unlock()
+
+		br := bufio.NewReader(rd)
+		for {
+			line, _, err := readCommand(br)
+			if err != nil {
+				return
+			}
+			if line == "NOP\n" {
+				continue
+			}
+			if err := writeFramedResponse(wr, FrameTypeResponse, []byte("OK")); err != nil {
+				return
+			}
+		}
+	}
+	k.mockNSQD = m
+	return k
+}
+
+func (k *killableMockNSQD) killCurrentConn() {
+	k.mtx.Lock()
+	defer k.mtx.Unlock()
+	if k.conn != nil {
+		k.conn.Close()
+		k.conn = nil
+	}
+}
+
+func TestWriterReconnectsAfterKill(t *testing.T) {
+	nsqd := newKillableMockNSQD(t)
+	defer nsqd.Close()
+
+	w := NewWriter(nsqd.Addr(), "")
+	w.ReconnectInitialDelay = 10 * time.Millisecond
+	w.ReconnectMaxDelay = 50 * time.Millisecond
+	defer w.Stop()
+
+	var mtx sync.Mutex
+	var states []int32
+	w.SetConnectionStateHandler(func(state int32, err error) {
+		mtx.Lock()
+		states = append(states, state)
+		mtx.Unlock()
+	})
+
+	if _, _, err := w.Publish("test-topic", []byte("hello")); err != nil {
+		t.Fatalf("initial Publish failed: %s", err)
+	}
+
+	nsqd.killCurrentConn()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if _, _, err := w.Publish("test-topic", []byte("hello")); err == nil {
+			mtx.Lock()
+			defer mtx.Unlock()
+			if len(states) < 3 {
+				t.Fatalf("expected Connected/Disconnected/Connected state transitions, got %v", states)
+			}
+			if stats := w.Stats(); stats.Reconnects != 1 {
+				t.Fatalf("expected exactly 1 recorded reconnect, got %d", stats.Reconnects)
+			}
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("publish did not resume automatically after nsqd connection was killed")
+}
@@ -0,0 +1,216 @@
+package nsq
+
+import (
+	"bufio"
+	"compress/flate"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mreiferson/go-snappystream"
+)
+
+// mockNSQD is a minimal nsqd stand-in for exercising Writer's connect()
+// handshake (IDENTIFY plus whatever compression/TLS upgrade identResp
+// advertises) without a real nsqd binary. onConn, if set, lets a test take
+// over the post-handshake connection directly (e.g. to kill it for
+// reconnect tests) instead of running the default OK-everything loop.
+type mockNSQD struct {
+	ln        net.Listener
+	identResp identifyResponse
+	tlsConfig *tls.Config
+	onConn    func(t *testing.T, r io.Reader, w io.Writer)
+}
+
+func newMockNSQD(t *testing.T, resp identifyResponse) *mockNSQD {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %s", err)
+	}
+	m := &mockNSQD{ln: ln, identResp: resp}
+	go m.serve(t)
+	return m
+}
+
+func (m *mockNSQD) Addr() string {
+	return m.ln.Addr().String()
+}
+
+func (m *mockNSQD) Close() {
+	m.ln.Close()
+}
+
+func writeFramedResponse(w io.Writer, frameType int32, data []byte) error {
+	var buf [8]byte
+	binary.BigEndian.PutUint32(buf[0:4], uint32(len(data)+4))
+	binary.BigEndian.PutUint32(buf[4:8], uint32(frameType))
+	if _, err := w.Write(buf[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(data)
+	return err
+}
+
+// readCommand reads a single nsqd command line, plus its body for the
+// commands (IDENTIFY, PUB, MPUB) that carry a size-prefixed payload.
+func readCommand(r *bufio.Reader) (line string, body []byte, err error) {
+	line, err = r.ReadString('\n')
+	if err != nil {
+		return "", nil, err
+	}
+	if line == "IDENTIFY\n" || strings.HasPrefix(line, "PUB ") || strings.HasPrefix(line, "MPUB ") {
+		var szBuf [4]byte
+		if _, err := io.ReadFull(r, szBuf[:]); err != nil {
+			return "", nil, err
+		}
+		sz := binary.BigEndian.Uint32(szBuf[:])
+		body = make([]byte, sz)
+		if _, err := io.ReadFull(r, body); err != nil {
+			return "", nil, err
+		}
+	}
+	return line, body, nil
+}
+
+func (m *mockNSQD) serve(t *testing.T) {
+	for {
+		conn, err := m.ln.Accept()
+		if err != nil {
+			return
+		}
+		go m.handle(t, conn)
+	}
+}
+
+func (m *mockNSQD) handle(t *testing.T, conn net.Conn) {
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+
+	magic := make([]byte, 4)
+	if _, err := io.ReadFull(r, magic); err != nil {
+		return
+	}
+
+	_, body, err := readCommand(r)
+	if err != nil {
+		return
+	}
+	var ci map[string]interface{}
+	if err := json.Unmarshal(body, &ci); err != nil {
+		return
+	}
+
+	respData, _ := json.Marshal(m.identResp)
+	if err := writeFramedResponse(conn, FrameTypeResponse, respData); err != nil {
+		return
+	}
+
+	var rd io.Reader = r
+	var wr io.Writer = conn
+
+	if m.identResp.TLSv1 {
+		tlsConn := tls.Server(conn, m.tlsConfig)
+		if err := tlsConn.Handshake(); err != nil {
+			return
+		}
+		conn = tlsConn
+		r = bufio.NewReader(conn)
+		if err := writeFramedResponse(conn, FrameTypeResponse, []byte("OK")); err != nil {
+			return
+		}
+		rd = r
+		wr = conn
+	}
+
+	if m.identResp.Snappy {
+		rd = snappystream.NewReader(r, false)
+		wr = snappystream.NewWriter(conn)
+		if err := writeFramedResponse(wr, FrameTypeResponse, []byte("OK")); err != nil {
+			return
+		}
+	} else if m.identResp.Deflate {
+		rd = flate.NewReader(r)
+		fw, _ := flate.NewWriter(conn, flate.DefaultCompression)
+		wr = fw
+		if err := writeFramedResponse(wr, FrameTypeResponse, []byte("OK")); err != nil {
+			return
+		}
+		fw.Flush()
+	}
+
+	if m.onConn != nil {
+		m.onConn(t, rd, wr)
+		return
+	}
+
+	br := bufio.NewReader(rd)
+	for {
+		line, _, err := readCommand(br)
+		if err != nil {
+			return
+		}
+		if line == "NOP\n" {
+			continue
+		}
+		if err := writeFramedResponse(wr, FrameTypeResponse, []byte("OK")); err != nil {
+			return
+		}
+		if fw, ok := wr.(*flate.Writer); ok {
+			fw.Flush()
+		}
+	}
+}
+
+func TestWriterSnappyCompression(t *testing.T) {
+	nsqd := newMockNSQD(t, identifyResponse{Snappy: true})
+	defer nsqd.Close()
+
+	w := NewWriter(nsqd.Addr(), "")
+	w.Snappy = true
+	defer w.Stop()
+
+	frameType, _, err := w.Publish("test-topic", []byte("hello"))
+	if err != nil {
+		t.Fatalf("Publish failed: %s", err)
+	}
+	if frameType != FrameTypeResponse {
+		t.Fatalf("expected FrameTypeResponse, got %d", frameType)
+	}
+}
+
+func TestWriterDeflateCompression(t *testing.T) {
+	nsqd := newMockNSQD(t, identifyResponse{Deflate: true})
+	defer nsqd.Close()
+
+	w := NewWriter(nsqd.Addr(), "")
+	w.Deflate = true
+	w.DeflateLevel = flate.DefaultCompression
+	defer w.Stop()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		frameType, _, err := w.Publish("test-topic", []byte("hello"))
+		if err != nil {
+			t.Errorf("Publish failed: %s", err)
+			return
+		}
+		if frameType != FrameTypeResponse {
+			t.Errorf("expected FrameTypeResponse, got %d", frameType)
+		}
+	}()
+
+	// If the flate writer is never flushed, this Publish hangs forever
+	// waiting on a response nsqd can't have sent yet.
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Publish over deflate did not complete - flate writer likely never flushed")
+	}
+}
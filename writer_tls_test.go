@@ -0,0 +1,82 @@
+package nsq
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+// selfSignedTLSConfig generates an ephemeral self-signed cert/key pair for
+// localhost so mockNSQD can terminate a TLS handshake in-process.
+func selfSignedTLSConfig(t *testing.T) *tls.Config {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate key: %s", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %s", err)
+	}
+
+	cert := tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  key,
+	}
+	return &tls.Config{Certificates: []tls.Certificate{cert}}
+}
+
+func TestWriterTLS(t *testing.T) {
+	nsqd := newMockNSQD(t, identifyResponse{TLSv1: true})
+	nsqd.tlsConfig = selfSignedTLSConfig(t)
+	defer nsqd.Close()
+
+	w := NewWriter(nsqd.Addr(), "")
+	w.TLS = true
+	w.TLSConfig = &tls.Config{InsecureSkipVerify: true}
+	defer w.Stop()
+
+	frameType, _, err := w.Publish("test-topic", []byte("hello"))
+	if err != nil {
+		t.Fatalf("Publish failed: %s", err)
+	}
+	if frameType != FrameTypeResponse {
+		t.Fatalf("expected FrameTypeResponse, got %d", frameType)
+	}
+}
+
+func TestWriterTLSThenSnappy(t *testing.T) {
+	nsqd := newMockNSQD(t, identifyResponse{TLSv1: true, Snappy: true})
+	nsqd.tlsConfig = selfSignedTLSConfig(t)
+	defer nsqd.Close()
+
+	w := NewWriter(nsqd.Addr(), "")
+	w.TLS = true
+	w.TLSConfig = &tls.Config{InsecureSkipVerify: true}
+	w.Snappy = true
+	defer w.Stop()
+
+	frameType, _, err := w.Publish("test-topic", []byte("hello"))
+	if err != nil {
+		t.Fatalf("Publish failed: %s", err)
+	}
+	if frameType != FrameTypeResponse {
+		t.Fatalf("expected FrameTypeResponse, got %d", frameType)
+	}
+}